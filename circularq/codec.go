@@ -0,0 +1,30 @@
+package circularq
+
+import "encoding/json"
+
+// Codec serializes Messages for persistence in the WAL. JSONCodec is the
+// default; plug in a Codec backed by protobuf or gob when messages need a
+// tighter or schema-aware wire format.
+type Codec interface {
+	Encode(msg Message) (data []byte, err error)
+	Decode(data []byte) (msg Message, err error)
+}
+
+// JSONCodec encodes messages with encoding/json. Decode returns whatever
+// concrete type json.Unmarshal produces for the payload (e.g. numbers come
+// back as float64), so callers that round-trip typed messages through the
+// WAL should use a Codec that preserves their concrete type instead.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(msg Message) (data []byte, err error) {
+	return json.Marshal(msg)
+}
+
+func (JSONCodec) Decode(data []byte) (msg Message, err error) {
+	var decoded interface{}
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		return
+	}
+	msg = decoded
+	return
+}
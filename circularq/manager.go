@@ -0,0 +1,353 @@
+package circularq
+
+import (
+	"container/list"
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultManagerTickInterval is how often the Manager's background loop
+// looks for a due queue to flush when no tick interval is configured.
+const DefaultManagerTickInterval = 100 * time.Millisecond
+
+type (
+	// Manager owns many CircularQ instances keyed by a caller-supplied
+	// string (tenant, stream, fingerprint, ...), mirroring how Loki's
+	// ingester shards flushes by user+fingerprint. Each key's queue is
+	// driven by a single shared background loop instead of a goroutine
+	// pool per key.
+	Manager struct {
+		ctx          context.Context
+		factory      func(key string) FlusherFunc
+		base         Config
+		maxQueues    int
+		tickInterval time.Duration
+
+		mu       sync.Mutex
+		queues   map[string]*managedQueue
+		lru      *list.List
+		evicting map[string]chan struct{}
+
+		metrics managerMetrics
+		wg      sync.WaitGroup
+	}
+
+	managedQueue struct {
+		key     string
+		queue   *CircularQ
+		lruElem *list.Element
+	}
+
+	managerMetrics struct {
+		messagesStored  atomic.Uint64
+		messagesFlushed atomic.Uint64
+		flushErrors     atomic.Uint64
+	}
+
+	// ManagerMetrics is a point-in-time snapshot of a Manager's
+	// Prometheus-style counters, returned by Manager.Metrics.
+	ManagerMetrics struct {
+		MessagesStoredTotal  uint64
+		MessagesFlushedTotal uint64
+		FlushErrorsTotal     uint64
+		QueueLength          int
+	}
+
+	// ManagerOption configures a Manager constructed via NewManager.
+	ManagerOption func(*Manager)
+)
+
+// WithMaxQueues bounds how many per-key queues a Manager keeps at once. Once
+// the bound is reached, storing a message for a new key evicts the
+// least-recently-used queue, flushing it to completion first.
+func WithMaxQueues(maxQueues int) ManagerOption {
+	return func(m *Manager) {
+		m.maxQueues = maxQueues
+	}
+}
+
+// WithBaseConfig sets the Config template each per-key queue is derived
+// from. Without this option the Manager reads DefaultConfigFile, same as
+// New.
+func WithBaseConfig(base Config) ManagerOption {
+	return func(m *Manager) {
+		m.base = base
+	}
+}
+
+// WithTickInterval overrides how often the background loop looks for a due
+// queue to flush. Defaults to DefaultManagerTickInterval.
+func WithTickInterval(interval time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.tickInterval = interval
+	}
+}
+
+// NewManager creates a Manager. factory builds the FlusherFunc for a given
+// key the first time that key is stored to.
+func NewManager(ctx context.Context, factory func(key string) FlusherFunc, opts ...ManagerOption) (m *Manager, err error) {
+	m = &Manager{
+		ctx:      ctx,
+		factory:  factory,
+		queues:   make(map[string]*managedQueue),
+		lru:      list.New(),
+		evicting: make(map[string]chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.tickInterval <= 0 {
+		m.tickInterval = DefaultManagerTickInterval
+	}
+	if m.base == (Config{}) {
+		var base *Config
+		if base, err = readConfigFile(DefaultConfigFile); err != nil {
+			return
+		}
+		m.base = *base
+	}
+
+	m.wg.Add(1)
+	go m.flushLoop()
+	return
+}
+
+// Keys returns the keys of every queue currently tracked by the Manager.
+func (m *Manager) Keys() (keys []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.queues {
+		keys = append(keys, key)
+	}
+	return
+}
+
+// Store appends msg to key's queue, creating it (via factory) on first use.
+func (m *Manager) Store(key string, msg Message) (err error) {
+	mq, err := m.lookupOrCreate(key)
+	if err != nil {
+		return
+	}
+
+	if err = mq.queue.Store(msg); err != nil {
+		return
+	}
+	m.metrics.messagesStored.Add(1)
+	return
+}
+
+// lookupOrCreate returns key's queue, creating it on first use. If key was
+// just evicted by another goroutine and hasn't finished flushing yet, it
+// waits for that flush to complete (without holding m.mu, so unrelated keys
+// are never blocked) before creating a fresh queue for key - otherwise two
+// *fileWAL instances could end up open on the same WAL directory at once.
+func (m *Manager) lookupOrCreate(key string) (mq *managedQueue, err error) {
+	for {
+		m.mu.Lock()
+		if wait, evicting := m.evicting[key]; evicting {
+			m.mu.Unlock()
+			<-wait
+			continue
+		}
+
+		if existing, ok := m.queues[key]; ok {
+			m.lru.MoveToFront(existing.lruElem)
+			m.mu.Unlock()
+			return existing, nil
+		}
+
+		var evicted *managedQueue
+		mq, evicted, err = m.addQueueLocked(key)
+		m.mu.Unlock()
+
+		// Flush whatever was evicted regardless of whether creating key's
+		// own queue above succeeded - the eviction already happened and
+		// its messages must not be silently dropped.
+		if evicted != nil {
+			m.flushEvicted(evicted)
+		}
+		return
+	}
+}
+
+// addQueueLocked creates key's queue, evicting the least-recently-used
+// queue first if the Manager is at MaxQueues capacity. The evicted queue
+// (if any) is returned for the caller to flush outside m.mu, regardless of
+// whether creating key's own queue went on to succeed. Callers must hold
+// m.mu.
+func (m *Manager) addQueueLocked(key string) (mq, evicted *managedQueue, err error) {
+	if m.maxQueues > 0 && len(m.queues) >= m.maxQueues {
+		evicted = m.evictLocked()
+	}
+
+	configCopy := m.configForLocked(key)
+	var queue *CircularQ
+	if queue, err = newUnstarted(m.ctx, m.factory(key), &configCopy); err != nil {
+		return
+	}
+
+	mq = &managedQueue{key: key, queue: queue}
+	mq.lruElem = m.lru.PushFront(mq)
+	m.queues[key] = mq
+	return
+}
+
+// configForLocked derives a per-key Config from the base template, giving
+// each key its own WAL directory so replaying one key's segments never
+// mixes in another's.
+func (m *Manager) configForLocked(key string) (cfg Config) {
+	cfg = m.base
+	if cfg.WAL != nil {
+		walCfg := *cfg.WAL
+		walCfg.Dir = filepath.Join(cfg.WAL.Dir, key)
+		cfg.WAL = &walCfg
+	}
+	if cfg.Retry != nil {
+		retryCfg := *cfg.Retry
+		cfg.Retry = &retryCfg
+	}
+	return
+}
+
+// evictLocked removes the least-recently-used queue from the map and LRU
+// list and returns it for the caller to flush once m.mu is released. The
+// key is marked as evicting until flushEvicted finishes, so a racing
+// lookupOrCreate for the same key waits instead of opening a second
+// *fileWAL on the same directory. Callers must hold m.mu.
+func (m *Manager) evictLocked() (evicted *managedQueue) {
+	elem := m.lru.Back()
+	if elem == nil {
+		return
+	}
+	evicted = elem.Value.(*managedQueue)
+	m.lru.Remove(elem)
+	delete(m.queues, evicted.key)
+	m.evicting[evicted.key] = make(chan struct{})
+	return
+}
+
+// flushEvicted drains an evicted queue to completion, then releases any
+// lookupOrCreate calls waiting on this key. Called without m.mu held, so a
+// slow or failing flush here never blocks Store for other keys.
+func (m *Manager) flushEvicted(mq *managedQueue) {
+	before := mq.queue.Length()
+	if err := mq.queue.FlushAll(); err != nil {
+		m.metrics.flushErrors.Add(1)
+	} else {
+		m.metrics.messagesFlushed.Add(uint64(before - mq.queue.Length()))
+	}
+
+	m.mu.Lock()
+	if wait, ok := m.evicting[mq.key]; ok {
+		close(wait)
+		delete(m.evicting, mq.key)
+	}
+	m.mu.Unlock()
+}
+
+// Flush flushes one batch for key, same as CircularQ.Flush. It is a no-op
+// for a key that has never been stored to.
+func (m *Manager) Flush(key string) (err error) {
+	m.mu.Lock()
+	mq, ok := m.queues[key]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	return m.flushQueue(mq.queue)
+}
+
+// FlushAll drains every key's queue to empty.
+func (m *Manager) FlushAll() (err error) {
+	for _, key := range m.Keys() {
+		m.mu.Lock()
+		mq, ok := m.queues[key]
+		m.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		before := mq.queue.Length()
+		if ferr := mq.queue.FlushAll(); ferr != nil {
+			m.metrics.flushErrors.Add(1)
+			err = ferr
+			continue
+		}
+		m.metrics.messagesFlushed.Add(uint64(before - mq.queue.Length()))
+	}
+	return
+}
+
+func (m *Manager) flushQueue(queue *CircularQ) (err error) {
+	before := queue.Length()
+	if err = queue.Flush(); err != nil {
+		m.metrics.flushErrors.Add(1)
+		return
+	}
+	m.metrics.messagesFlushed.Add(uint64(before - queue.Length()))
+	return
+}
+
+// Metrics returns a snapshot of the Manager's Prometheus-style counters.
+func (m *Manager) Metrics() (metrics ManagerMetrics) {
+	m.mu.Lock()
+	length := 0
+	for _, mq := range m.queues {
+		length += mq.queue.Length()
+	}
+	m.mu.Unlock()
+
+	metrics = ManagerMetrics{
+		MessagesStoredTotal:  m.metrics.messagesStored.Load(),
+		MessagesFlushedTotal: m.metrics.messagesFlushed.Load(),
+		FlushErrorsTotal:     m.metrics.flushErrors.Load(),
+		QueueLength:          length,
+	}
+	return
+}
+
+// flushLoop fairly round-robins across keys: each tick it flushes one batch
+// from whichever due queue (ShouldFlush) has gone longest since its last
+// flush, instead of running a dedicated goroutine per queue.
+func (m *Manager) flushLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.flushNextDue()
+		case <-m.ctx.Done():
+			m.FlushAll()
+			return
+		}
+	}
+}
+
+func (m *Manager) flushNextDue() {
+	m.mu.Lock()
+	var (
+		oldest     *managedQueue
+		oldestTime time.Time
+	)
+	for _, mq := range m.queues {
+		if !mq.queue.ShouldFlush() {
+			continue
+		}
+		lastFlushTime := mq.queue.LastFlushTime()
+		if oldest == nil || lastFlushTime.Before(oldestTime) {
+			oldest = mq
+			oldestTime = lastFlushTime
+		}
+	}
+	m.mu.Unlock()
+
+	if oldest == nil {
+		return
+	}
+	m.flushQueue(oldest.queue)
+}
@@ -0,0 +1,105 @@
+package circularq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func DummyManagerConfig() Config {
+	return Config{
+		FrequencyThreshold:  5,
+		RolloverThreshold:   10,
+		TimeThresholdInSecs: 3600,
+	}
+}
+
+func DummyManager(t *testing.T, opts ...ManagerOption) *Manager {
+	opts = append([]ManagerOption{WithBaseConfig(DummyManagerConfig())}, opts...)
+	m, err := NewManager(context.TODO(), func(key string) FlusherFunc {
+		return LogFlusherFunc
+	}, opts...)
+	assert.Nil(t, err)
+	return m
+}
+
+func TestManagerStoreIsolatesQueuesByKey(t *testing.T) {
+	m := DummyManager(t)
+
+	assert.Nil(t, m.Store("tenant-a", 1))
+	assert.Nil(t, m.Store("tenant-a", 2))
+	assert.Nil(t, m.Store("tenant-b", 1))
+
+	assert.Equal(t, len(m.Keys()), 2)
+	assert.Equal(t, m.Metrics().QueueLength, 3)
+}
+
+func TestManagerFlushDrainsOnlyRequestedKey(t *testing.T) {
+	m := DummyManager(t)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, m.Store("tenant-a", i))
+		assert.Nil(t, m.Store("tenant-b", i))
+	}
+
+	assert.Nil(t, m.Flush("tenant-a"))
+	assert.Equal(t, m.Metrics().QueueLength, 3)
+}
+
+func TestManagerFlushAllDrainsEveryKey(t *testing.T) {
+	m := DummyManager(t)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, m.Store("tenant-a", i))
+		assert.Nil(t, m.Store("tenant-b", i))
+	}
+
+	assert.Nil(t, m.FlushAll())
+	assert.Equal(t, m.Metrics().QueueLength, 0)
+}
+
+func TestManagerMaxQueuesEvictsLeastRecentlyUsed(t *testing.T) {
+	m := DummyManager(t, WithMaxQueues(2))
+
+	assert.Nil(t, m.Store("tenant-a", 1))
+	assert.Nil(t, m.Store("tenant-b", 1))
+	// Touch tenant-a so tenant-b becomes the least-recently-used key.
+	assert.Nil(t, m.Store("tenant-a", 2))
+	assert.Nil(t, m.Store("tenant-c", 1))
+
+	keys := m.Keys()
+	assert.Equal(t, len(keys), 2)
+	for _, key := range keys {
+		assert.True(t, key != "tenant-b")
+	}
+	// tenant-b was flushed synchronously on eviction, not dropped.
+	assert.Equal(t, m.Metrics().MessagesFlushedTotal, uint64(1))
+}
+
+func TestManagerStoreRecreatesKeyAfterItsEviction(t *testing.T) {
+	m := DummyManager(t, WithMaxQueues(1))
+
+	assert.Nil(t, m.Store("tenant-a", 1))
+	// Evicts tenant-a and flushes it synchronously within this Store, so
+	// the Store below recreates tenant-a from scratch. Nothing runs
+	// concurrently here, so lookupOrCreate's wait on an in-flight eviction
+	// is not exercised.
+	assert.Nil(t, m.Store("tenant-b", 1))
+	assert.Nil(t, m.Store("tenant-a", 2))
+
+	assert.Equal(t, len(m.Keys()), 1)
+	assert.Equal(t, m.Metrics().QueueLength, 1)
+}
+
+func TestManagerMetricsCountStoresAndFlushes(t *testing.T) {
+	m := DummyManager(t)
+
+	assert.Nil(t, m.Store("tenant-a", 1))
+	assert.Nil(t, m.Store("tenant-a", 2))
+	assert.Nil(t, m.Flush("tenant-a"))
+
+	metrics := m.Metrics()
+	assert.Equal(t, metrics.MessagesStoredTotal, uint64(2))
+	assert.Equal(t, metrics.MessagesFlushedTotal, uint64(2))
+}
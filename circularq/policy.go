@@ -0,0 +1,131 @@
+package circularq
+
+import "time"
+
+// Stats is a point-in-time snapshot of a CircularQ's state, handed to
+// BatchPolicy so it can decide whether/how much to flush without holding
+// the queue's lock.
+type Stats struct {
+	Length              int
+	FrequencyThreshold  int
+	RolloverThreshold   int
+	TimeThresholdInSecs int
+	LastFlushTime       time.Time
+
+	// Messages are the currently buffered messages, oldest first. Policies
+	// that need to inspect message contents (e.g. SizeBytesPolicy) read
+	// from here instead of going back to the queue.
+	Messages []Message
+}
+
+// BatchPolicy decides when a CircularQ should flush and how large the next
+// batch should be. It replaces the package's original hardcoded OR of a
+// frequency and a time threshold with something pluggable and composable.
+type BatchPolicy interface {
+	ShouldFlush(stats Stats) bool
+	NextBatchSize(stats Stats) int
+}
+
+// FrequencyPolicy flushes once at least Threshold messages are buffered.
+type FrequencyPolicy struct {
+	Threshold int
+}
+
+func (p FrequencyPolicy) ShouldFlush(stats Stats) bool {
+	return stats.Length >= p.Threshold
+}
+
+func (p FrequencyPolicy) NextBatchSize(stats Stats) int {
+	if stats.Length < p.Threshold {
+		return stats.Length
+	}
+	return p.Threshold
+}
+
+// TimePolicy flushes once Threshold has elapsed since the last flush. It
+// never caps the batch size on its own.
+type TimePolicy struct {
+	Threshold time.Duration
+}
+
+func (p TimePolicy) ShouldFlush(stats Stats) bool {
+	return time.Since(stats.LastFlushTime) > p.Threshold
+}
+
+func (p TimePolicy) NextBatchSize(stats Stats) int {
+	return stats.Length
+}
+
+// SizeBytesPolicy flushes once the buffered messages' combined size, as
+// measured by Sizer, reaches Threshold bytes.
+type SizeBytesPolicy struct {
+	Sizer     func(Message) int
+	Threshold int
+}
+
+func (p SizeBytesPolicy) ShouldFlush(stats Stats) bool {
+	size := 0
+	for _, msg := range stats.Messages {
+		size += p.Sizer(msg)
+		if size >= p.Threshold {
+			return true
+		}
+	}
+	return false
+}
+
+func (p SizeBytesPolicy) NextBatchSize(stats Stats) int {
+	size := 0
+	for idx, msg := range stats.Messages {
+		size += p.Sizer(msg)
+		if size >= p.Threshold {
+			return idx + 1
+		}
+	}
+	return len(stats.Messages)
+}
+
+// CompositeMode selects how CompositePolicy combines its child policies.
+type CompositeMode int
+
+const (
+	// AnyMode flushes as soon as any child policy wants to flush.
+	AnyMode CompositeMode = iota
+	// AllMode flushes only once every child policy wants to flush.
+	AllMode
+)
+
+// CompositePolicy combines multiple policies under AnyMode or AllMode.
+// NextBatchSize always returns the smallest size requested by any child
+// policy, so no individual policy's limit (e.g. a byte budget) is ever
+// exceeded regardless of mode.
+type CompositePolicy struct {
+	Policies []BatchPolicy
+	Mode     CompositeMode
+}
+
+func (p CompositePolicy) ShouldFlush(stats Stats) bool {
+	if len(p.Policies) == 0 {
+		return false
+	}
+	for _, policy := range p.Policies {
+		flush := policy.ShouldFlush(stats)
+		if p.Mode == AnyMode && flush {
+			return true
+		}
+		if p.Mode == AllMode && !flush {
+			return false
+		}
+	}
+	return p.Mode == AllMode
+}
+
+func (p CompositePolicy) NextBatchSize(stats Stats) int {
+	size := stats.Length
+	for _, policy := range p.Policies {
+		if n := policy.NextBatchSize(stats); n < size {
+			size = n
+		}
+	}
+	return size
+}
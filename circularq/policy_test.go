@@ -0,0 +1,54 @@
+package circularq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizeBytesPolicyCapsBatchSize(t *testing.T) {
+	q := DummyQueue()
+	q.Policy = SizeBytesPolicy{Sizer: func(Message) int { return 1 }, Threshold: 5}
+	FillBuffer(q, 10)
+
+	assert.True(t, q.Policy.ShouldFlush(q.Stats()))
+	messages, err := q.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, len(messages), 5)
+}
+
+func TestCompositePolicyAnyMode(t *testing.T) {
+	q := DummyUnstartedQueue()
+	q.Policy = CompositePolicy{
+		Mode: AnyMode,
+		Policies: []BatchPolicy{
+			FrequencyPolicy{Threshold: q.config.FrequencyThreshold},
+			TimePolicy{Threshold: time.Hour},
+		},
+	}
+	FillBuffer(q, q.config.FrequencyThreshold)
+	assert.True(t, q.ShouldFlush())
+}
+
+func TestCompositePolicyAllMode(t *testing.T) {
+	q := DummyQueue()
+	q.Policy = CompositePolicy{
+		Mode: AllMode,
+		Policies: []BatchPolicy{
+			FrequencyPolicy{Threshold: 5},
+			SizeBytesPolicy{Sizer: func(Message) int { return 1 }, Threshold: 100},
+		},
+	}
+	FillBuffer(q, 10)
+	assert.False(t, q.ShouldFlush())
+
+	q.Policy = CompositePolicy{
+		Mode: AllMode,
+		Policies: []BatchPolicy{
+			FrequencyPolicy{Threshold: 5},
+			SizeBytesPolicy{Sizer: func(Message) int { return 1 }, Threshold: 5},
+		},
+	}
+	assert.True(t, q.ShouldFlush())
+}
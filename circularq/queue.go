@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -14,65 +15,164 @@ var (
 	DefaultConfigFile = BaseConfigFolder + "/config.json"
 )
 
+const (
+	// DefaultWorkers is used when the config does not specify how many
+	// flusher goroutines should be running.
+	DefaultWorkers = 1
+)
+
+var ErrQueueFull = errors.New("Queue is full")
+
 type (
 	Message     interface{}
 	FlusherFunc func([]Message) error
 
 	CircularQ struct {
 		Ctx    context.Context
+		mu     sync.RWMutex
 		store  []Message
 		config *Config
 
-		// The startIdx and stopIdx represent the starting and ending indices of
-		// the store. The store is a circular buffer, so the startIdx and stopIdx
-		// are not necessarily the first and last indices of the store.
-		// The stopIdx is incremented by 1 after every Store() call.
-		// The startIdx is set to the length of the flushed messages after every
-		// Flush() call.
-		// In cases where the startIdx is greater than the stopIdx, the length
-		// of the store is calculated as (stopIdx - startIdx).
-		// When the startIdx is less than the stopIdx, the length of the store
-		// is calculated as (stopIdx - startIdx).
-		// When the startIdx or stopIdx exceeds the RollOverThreshold, it is reset to 0.
-		// The stopIdx is not included in the calculation of the length of the store.
-		// So if the startIdx is 0 and stopIdx is 100, the length of the store is 100.
-		// If the stopIdx is 100, it means we can flush messages till the 99th index.
-		// The startIdx is inclusive of the value as well.
-		// After a flush happens, the startIdx is set to the length of the flushed messages.
-		// For example, if the startIdx is at 10 and the length of flushed events is 90,
-		// then the startIdx should be set to 90 + 10 = 100, which means the next value is
-		// at index 100. The stopIdx should be set to startIdx + 1
+		// store is a fixed-size ring buffer of length config.RolloverThreshold,
+		// allocated once in New. startIdx is the read cursor (the oldest
+		// buffered message), stopIdx is the write cursor (where the next
+		// Store() lands), both modulo len(store). count is the number of
+		// live messages currently buffered, which disambiguates a full
+		// buffer from an empty one when startIdx == stopIdx.
 		startIdx      int
 		stopIdx       int
+		count         int
 		lastFlushTime time.Time
 
 		FlusherFunc FlusherFunc
+
+		// flushSignal is pinged by Store whenever the frequency threshold is
+		// crossed, so the background loop doesn't have to wait for the next
+		// tick of the time threshold ticker.
+		flushSignal chan struct{}
+		// batches carries pulled-off batches from the background loop to the
+		// flusher worker pool, so Store is never blocked on FlusherFunc.
+		batches chan []Message
+		wg      sync.WaitGroup
+
+		// flushMu serializes the GetMessages-through-PostFlush sequence of
+		// every flush, explicit or background. GetMessages always starts
+		// from startIdx, so two overlapping flushes - an explicit Flush
+		// racing the background dispatchFlush, or either racing itself via
+		// the worker pool - would hand out the same messages twice and
+		// double-advance the cursor once both completed. dispatchFlush only
+		// ever tries to acquire it, skipping its turn if a flush is already
+		// in progress; Flush (and therefore FlushAll) blocks until it can,
+		// since callers expect it to actually flush a batch.
+		flushMu sync.Mutex
+
+		// wal is the optional write-ahead log backing Store when
+		// config.WAL is set. walTruncateSeq tracks how many WAL records
+		// have been consumed (flushed, or dropped via Overwrite) so far,
+		// which is what gets passed to wal.Truncate.
+		wal            WAL
+		walTruncateSeq uint64
+
+		// Policy decides when to flush and how large a batch to pull.
+		// Defaults to a CompositePolicy in AnyMode over FrequencyPolicy
+		// and TimePolicy, matching the original hardcoded OR of
+		// thresholds.
+		Policy BatchPolicy
+
+		// DeadLetterFunc, if set, is invoked with a batch and its last
+		// error once retries for that batch are exhausted. Returning nil
+		// advances the queue past the batch; returning an error leaves it
+		// in place and surfaces a terminal *FlushError from Flush.
+		DeadLetterFunc func([]Message, error) error
 	}
 
 	Config struct {
 		FrequencyThreshold  int `json:"frequency_threshold"`
 		RolloverThreshold   int `json:"rollover_threshold"`
 		TimeThresholdInSecs int `json:"time_threshold_in_secs"`
+
+		// Workers controls how many goroutines drain batches handed off by
+		// the background flush loop. Defaults to DefaultWorkers.
+		Workers int `json:"workers"`
+
+		// Overwrite, when true, makes Store() on a full buffer drop the
+		// oldest message instead of returning ErrQueueFull.
+		Overwrite bool `json:"overwrite"`
+
+		// WAL, when set, makes Store durable: messages are appended to a
+		// write-ahead log before the in-memory buffer is touched, and are
+		// replayed into the buffer on New if the process restarted with
+		// unflushed messages still on disk.
+		WAL *WALConfig `json:"wal,omitempty"`
+
+		// Retry configures the exponential backoff retried around
+		// FlusherFunc. A nil Retry means no retries: a single failed
+		// attempt goes straight to DeadLetterFunc (or a terminal error).
+		Retry *RetryConfig `json:"retry,omitempty"`
 	}
 )
 
 func New(ctx context.Context, flusherFunc FlusherFunc) (q *CircularQ, err error) {
-	q = &CircularQ{
-		Ctx:         ctx,
-		FlusherFunc: flusherFunc,
+	var config *Config
+	if config, err = readConfigFile(DefaultConfigFile); err != nil {
+		return
 	}
-	if q.config, err = q.readConfig(); err != nil {
+	if q, err = newUnstarted(ctx, flusherFunc, config); err != nil {
 		return
 	}
+	q.startFlushers()
+	go q.flushLoop()
+	return
+}
+
+// newUnstarted builds a CircularQ around the given config without starting
+// its background flush loop or flusher pool. Manager uses this to drive
+// many per-key queues off a single shared loop instead of spawning a
+// goroutine pool per key.
+func newUnstarted(ctx context.Context, flusherFunc FlusherFunc, config *Config) (q *CircularQ, err error) {
+	q = &CircularQ{
+		Ctx:           ctx,
+		FlusherFunc:   flusherFunc,
+		flushSignal:   make(chan struct{}, 1),
+		config:        config,
+		lastFlushTime: time.Now(),
+	}
+	if q.config.Workers <= 0 {
+		q.config.Workers = DefaultWorkers
+	}
+	q.store = make([]Message, q.config.RolloverThreshold)
+	q.batches = make(chan []Message, q.config.Workers)
+	q.Policy = CompositePolicy{
+		Mode: AnyMode,
+		Policies: []BatchPolicy{
+			FrequencyPolicy{Threshold: q.config.FrequencyThreshold},
+			TimePolicy{Threshold: time.Duration(q.config.TimeThresholdInSecs) * time.Second},
+		},
+	}
+
+	if q.config.WAL != nil {
+		var w *fileWAL
+		if w, err = newFileWAL(q.config.WAL); err != nil {
+			return
+		}
+		q.wal = w
+		if err = w.Replay(q.storeFromReplay); err != nil {
+			return
+		}
+	}
 	return
 }
 
 func (q *CircularQ) readConfig() (config *Config, err error) {
+	return readConfigFile(DefaultConfigFile)
+}
+
+func readConfigFile(path string) (config *Config, err error) {
 	var (
 		confB []byte
 	)
 	config = &Config{}
-	if confB, err = ioutil.ReadFile(DefaultConfigFile); err != nil {
+	if confB, err = ioutil.ReadFile(path); err != nil {
 		return
 	}
 	if err = json.Unmarshal(confB, &config); err != nil {
@@ -81,35 +181,182 @@ func (q *CircularQ) readConfig() (config *Config, err error) {
 	return
 }
 
-func (q *CircularQ) Store(msg Message) (err error) {
-	if q.IsFull() {
-		err = errors.New("Queue is full")
+// flushLoop wakes up whenever the time threshold ticks or Store signals that
+// the frequency threshold was crossed, and hands off whatever is flushable to
+// the worker pool. On Ctx cancellation it drains the queue with a final
+// FlushAll before the flushers are torn down.
+func (q *CircularQ) flushLoop() {
+	ticker := time.NewTicker(time.Duration(q.config.TimeThresholdInSecs) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.dispatchFlush()
+		case <-q.flushSignal:
+			q.dispatchFlush()
+		case <-q.Ctx.Done():
+			q.FlushAll()
+			close(q.batches)
+			q.wg.Wait()
+			if q.wal != nil {
+				q.wal.Close()
+			}
+			return
+		}
+	}
+}
+
+// dispatchFlush pulls the next flushable batch off the queue and hands it to
+// the flusher worker pool. It only fires once q.Policy actually reports the
+// queue as due: the ticker and Store's flushSignal both wake flushLoop
+// unconditionally, so without this check a custom BatchPolicy would have no
+// say over when the standalone queue flushes. It never blocks Store:
+// GetMessages only reads under the lock, and handing the batch to q.batches
+// is the only blocking point, bounded by the configured number of workers.
+// That send also races against q.Ctx.Done() so a worker pool wedged on a
+// stuck flusher can never hold up shutdown: GetMessages doesn't advance any
+// cursor, so an abandoned batch is simply picked up again by the next flush.
+//
+// It only tries for q.flushMu, skipping this tick if a flush (dispatched or
+// explicit) is already in progress - unlike Flush, it has no caller waiting
+// on it to actually produce a batch, and the next tick or signal will try
+// again. flushMu is acquired before the Stats snapshot is taken (not just
+// before the batch is pulled), since a snapshot taken beforehand could go
+// stale if a concurrent Flush completed in between, re-flushing messages it
+// already advanced past. On a successful dispatch, flushMu stays held until
+// the worker pool finishes flushing this batch (see runFlusher), since
+// GetMessages always starts from startIdx and a second batch dispatched
+// before this one's PostFlush runs would hand out the same messages twice.
+func (q *CircularQ) dispatchFlush() {
+	if !q.flushMu.TryLock() {
 		return
 	}
-	q.store = append(q.store, msg)
-	if err = q.PostStore(); err != nil {
+
+	stats := q.Stats()
+	if !q.Policy.ShouldFlush(stats) {
+		q.flushMu.Unlock()
 		return
 	}
-	return
+
+	messages, err := q.messagesFromStats(stats)
+	if err != nil || len(messages) == 0 {
+		q.flushMu.Unlock()
+		return
+	}
+
+	select {
+	case q.batches <- messages:
+		// flushMu is released by runFlusher once this batch is flushed.
+	case <-q.Ctx.Done():
+		q.flushMu.Unlock()
+	}
 }
 
-func (q *CircularQ) PostStore() (err error) {
-	q.stopIdx = q.IncrIdx(q.stopIdx, 1)
+// startFlushers launches the configured number of worker goroutines that
+// pull batches off q.batches and flush them via FlusherFunc.
+func (q *CircularQ) startFlushers() {
+	for idx := 0; idx < q.config.Workers; idx++ {
+		q.wg.Add(1)
+		go q.runFlusher()
+	}
+}
+
+func (q *CircularQ) runFlusher() {
+	defer q.wg.Done()
+	for messages := range q.batches {
+		q.flushBatch(messages)
+		q.flushMu.Unlock()
+	}
+}
+
+func (q *CircularQ) Store(msg Message) (err error) {
+	q.mu.Lock()
+
+	dropOldest := false
+	if q.isFull() {
+		if !q.config.Overwrite {
+			q.mu.Unlock()
+			err = ErrQueueFull
+			return
+		}
+		dropOldest = true
+	}
+
+	if q.wal != nil {
+		if err = q.wal.Append(msg); err != nil {
+			q.mu.Unlock()
+			return
+		}
+	}
+
+	if dropOldest {
+		// Make room by dropping the oldest buffered message.
+		q.startIdx = q.nextIdx(q.startIdx)
+		q.count--
+		if q.wal != nil {
+			q.walTruncateSeq++
+		}
+	}
+	q.postStore(msg)
+	shouldSignal := q.Policy.ShouldFlush(q.cheapStatsLocked())
+	q.mu.Unlock()
+
+	if shouldSignal {
+		select {
+		case q.flushSignal <- struct{}{}:
+		default:
+		}
+	}
 	return
 }
 
-func (q *CircularQ) IncrIdx(val int, count int) (incrIdx int) {
-	for idx := 0; idx < count; idx++ {
-		incrIdx = val + 1
-		if incrIdx > q.config.RolloverThreshold {
-			incrIdx = 0
+// storeFromReplay writes a message recovered from the WAL directly into the
+// ring buffer. It is only used while New is still single-threaded (before
+// the flush loop and flushers are started), so it skips locking and
+// re-appending to the WAL.
+func (q *CircularQ) storeFromReplay(msg Message) (err error) {
+	if q.isFull() {
+		if !q.config.Overwrite {
+			err = ErrQueueFull
+			return
 		}
+		q.startIdx = q.nextIdx(q.startIdx)
+		q.count--
+		q.walTruncateSeq++
 	}
+	q.postStore(msg)
+	return
+}
+
+func (q *CircularQ) postStore(msg Message) {
+	q.store[q.stopIdx] = msg
+	q.stopIdx = q.nextIdx(q.stopIdx)
+	q.count++
+}
+
+// nextIdx returns idx advanced by one slot, wrapping around the capacity of
+// the ring buffer.
+func (q *CircularQ) nextIdx(idx int) int {
+	return q.IncrIdx(idx, 1)
+}
+
+// IncrIdx advances val by count slots, wrapping around the capacity of the
+// ring buffer (config.RolloverThreshold).
+func (q *CircularQ) IncrIdx(val int, count int) (incrIdx int) {
+	cap := q.config.RolloverThreshold
+	incrIdx = (val + count) % cap
 	return
 }
 
 func (q *CircularQ) IsFull() (isFull bool) {
-	if q.Length() >= q.config.RolloverThreshold {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.isFull()
+}
+
+func (q *CircularQ) isFull() (isFull bool) {
+	if q.count >= q.config.RolloverThreshold {
 		isFull = true
 		return
 	}
@@ -117,7 +364,13 @@ func (q *CircularQ) IsFull() (isFull bool) {
 }
 
 func (q *CircularQ) IsEmpty() (isEmpty bool) {
-	if q.Length() == 0 {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.isEmpty()
+}
+
+func (q *CircularQ) isEmpty() (isEmpty bool) {
+	if q.length() == 0 {
 		isEmpty = true
 		return
 	}
@@ -125,25 +378,41 @@ func (q *CircularQ) IsEmpty() (isEmpty bool) {
 }
 
 func (q *CircularQ) Length() (length int) {
-	if q.stopIdx >= q.startIdx {
-		length = q.stopIdx - q.startIdx
-		return
-	}
-	if q.stopIdx < q.startIdx {
-		length = q.startIdx - q.stopIdx
-	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.length()
+}
+
+func (q *CircularQ) length() (length int) {
+	length = q.count
 	return
 }
 
 func (q *CircularQ) HasFrequencyThresholdPassed() (hasPassed bool) {
-	if q.Length() >= q.config.FrequencyThreshold {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.hasFrequencyThresholdPassed()
+}
+
+func (q *CircularQ) hasFrequencyThresholdPassed() (hasPassed bool) {
+	if q.length() >= q.config.FrequencyThreshold {
 		hasPassed = true
 		return
 	}
 	return
 }
 
+// LastFlushTime returns the time of the last successful flush, or the
+// queue's creation time if it has never flushed.
+func (q *CircularQ) LastFlushTime() (lastFlushTime time.Time) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.lastFlushTime
+}
+
 func (q *CircularQ) HasTimeThresholdPassed() (hasPassed bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
 	if time.Since(q.lastFlushTime) > time.Duration(q.config.TimeThresholdInSecs)*time.Second {
 		hasPassed = true
 		return
@@ -152,29 +421,98 @@ func (q *CircularQ) HasTimeThresholdPassed() (hasPassed bool) {
 }
 
 func (q *CircularQ) ShouldFlush() (shouldFlush bool) {
-	if q.HasTimeThresholdPassed() {
-		shouldFlush = true
-		return
+	return q.Policy.ShouldFlush(q.Stats())
+}
+
+// Stats snapshots the queue's current state for BatchPolicy to inspect. It
+// copies out the currently buffered messages, so policies never hold the
+// queue's lock.
+func (q *CircularQ) Stats() (stats Stats) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.statsLocked()
+}
+
+// statsLocked builds the same snapshot as Stats, without acquiring the
+// lock. The caller must already hold at least a read lock.
+func (q *CircularQ) statsLocked() (stats Stats) {
+	stats = q.cheapStatsLocked()
+	stats.Messages = q.readMessages(q.count)
+	return
+}
+
+// cheapStatsLocked builds a Stats snapshot without copying the buffered
+// messages, so Store can ask Policy.ShouldFlush whether to ping flushSignal
+// without paying for an O(count) copy on every call. This is safe for
+// FrequencyPolicy/TimePolicy/CompositePolicy, which never look at
+// stats.Messages; a policy that does (e.g. SizeBytesPolicy) simply sees no
+// messages here and relies on the next tick's full-fidelity check in
+// dispatchFlush instead, which only costs a delay, not a correctness bug,
+// since dispatchFlush is what actually gates the flush. The caller must
+// already hold at least a read lock.
+func (q *CircularQ) cheapStatsLocked() (stats Stats) {
+	stats = Stats{
+		Length:              q.count,
+		FrequencyThreshold:  q.config.FrequencyThreshold,
+		RolloverThreshold:   q.config.RolloverThreshold,
+		TimeThresholdInSecs: q.config.TimeThresholdInSecs,
+		LastFlushTime:       q.lastFlushTime,
 	}
-	if q.HasFrequencyThresholdPassed() {
-		shouldFlush = true
+	return
+}
+
+// readMessages reads the oldest n buffered messages, starting at startIdx.
+// Since the store is a ring buffer the read may wrap around the end of the
+// underlying slice, so it happens in at most two contiguous segments. The
+// caller must hold at least a read lock.
+func (q *CircularQ) readMessages(n int) (messages []Message) {
+	if n > q.count {
+		n = q.count
+	}
+	if n == 0 {
 		return
 	}
+
+	cap := q.config.RolloverThreshold
+	messages = make([]Message, 0, n)
+
+	firstSegLen := cap - q.startIdx
+	if firstSegLen > n {
+		firstSegLen = n
+	}
+	messages = append(messages, q.store[q.startIdx:q.startIdx+firstSegLen]...)
+
+	if remaining := n - firstSegLen; remaining > 0 {
+		messages = append(messages, q.store[:remaining]...)
+	}
 	return
 }
 
+// GetMessages returns the next batch to flush, oldest first, sized by
+// Policy.NextBatchSize.
 func (q *CircularQ) GetMessages() (messages []Message, err error) {
-	batchStopSize := q.Length()
-	if batchStopSize > q.config.FrequencyThreshold {
-		batchStopSize = q.config.FrequencyThreshold
-	}
-	for idx := q.startIdx; idx < batchStopSize; idx++ {
-		messages = append(messages, q.store[idx])
+	return q.messagesFromStats(q.Stats())
+}
+
+// messagesFromStats sizes a batch out of an already-computed Stats snapshot,
+// so a caller that already called Stats() to evaluate Policy.ShouldFlush
+// (dispatchFlush) doesn't pay for a second O(count) copy of the buffered
+// messages just to then call GetMessages.
+func (q *CircularQ) messagesFromStats(stats Stats) (messages []Message, err error) {
+	batchSize := q.Policy.NextBatchSize(stats)
+	if batchSize > len(stats.Messages) {
+		batchSize = len(stats.Messages)
 	}
+	messages = stats.Messages[:batchSize]
 	return
 }
 
+// Flush flushes one batch, sized by Policy.NextBatchSize. It holds flushMu
+// for the duration, so it never overlaps a background dispatchFlush (or
+// another concurrent Flush) reading the same unadvanced startIdx.
 func (q *CircularQ) Flush() (err error) {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
 
 	var (
 		messages []Message
@@ -184,20 +522,40 @@ func (q *CircularQ) Flush() (err error) {
 		return
 	}
 
-	if err = q.FlusherFunc(messages); err != nil {
+	return q.flushBatch(messages)
+}
+
+// flushBatch runs FlusherFunc against messages with retries, handing the
+// batch to DeadLetterFunc once retries are exhausted, and advances the
+// queue past the batch on success (either FlusherFunc succeeding, or
+// DeadLetterFunc accepting the batch).
+func (q *CircularQ) flushBatch(messages []Message) (err error) {
+	if len(messages) == 0 {
 		return
 	}
-
-	if err = q.PostFlush(len(messages)); err != nil {
+	if err = q.flushWithRetry(messages); err != nil {
 		return
 	}
+	err = q.PostFlush(len(messages))
 	return
 }
 
 func (q *CircularQ) PostFlush(eventLen int) (err error) {
+	q.mu.Lock()
 	q.startIdx = q.IncrIdx(q.startIdx, eventLen)
-	q.stopIdx = q.IncrIdx(q.startIdx, 1)
+	q.count -= eventLen
 	q.lastFlushTime = time.Now()
+
+	wal := q.wal
+	if wal != nil {
+		q.walTruncateSeq += uint64(eventLen)
+	}
+	truncateSeq := q.walTruncateSeq
+	q.mu.Unlock()
+
+	if wal != nil {
+		err = wal.Truncate(truncateSeq)
+	}
 	return
 }
 
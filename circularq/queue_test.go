@@ -3,6 +3,7 @@ package circularq
 import (
 	"context"
 	"log"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -64,7 +65,91 @@ func TestStoreWhenFlushedAfterBeingFull(t *testing.T) {
 	err := q.Store(100)
 	log.Println(q.Length(), q.startIdx, q.stopIdx)
 	assert.Nil(t, err)
-	assert.Equal(t, q.Length(), q.config.RolloverThreshold-q.config.FrequencyThreshold)
+	// One flush frees FrequencyThreshold slots, and the extra Store above
+	// consumes one of them back.
+	assert.Equal(t, q.Length(), q.config.RolloverThreshold-q.config.FrequencyThreshold+1)
+}
+
+// DummyUnstartedQueue is DummyQueue without the background flush loop and
+// flusher pool, for tests that assert exact lengths or cursor positions.
+func DummyUnstartedQueue() (q *CircularQ) {
+	config, _ := readConfigFile(DefaultConfigFile)
+	q, _ = newUnstarted(context.TODO(), LogFlusherFunc, config)
+	return
+}
+
+func TestStoreWraparoundAtBoundary(t *testing.T) {
+	q := DummyQueue()
+
+	// Fill the buffer so the write cursor wraps back to 0, flush it empty,
+	// then store again so the new message lands in slot 0.
+	FillBuffer(q, q.config.RolloverThreshold)
+	assert.Nil(t, q.FlushAll())
+	assert.True(t, q.IsEmpty())
+	assert.Equal(t, q.startIdx, q.stopIdx)
+
+	err := q.Store(42)
+	assert.Nil(t, err)
+	assert.Equal(t, q.Length(), 1)
+
+	messages, err := q.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, []Message{42}, messages)
+}
+
+func TestGetMessagesSpanningWraparound(t *testing.T) {
+	q := DummyUnstartedQueue()
+
+	// Leave the read cursor a handful of slots before the end of the
+	// buffer, so a full-size batch has to be read in two segments.
+	FillBuffer(q, q.config.RolloverThreshold)
+	offset := 5
+	assert.Nil(t, q.PostFlush(q.config.RolloverThreshold-offset))
+	assert.Equal(t, q.startIdx, q.config.RolloverThreshold-offset)
+
+	FillBuffer(q, offset+q.config.FrequencyThreshold)
+
+	messages, err := q.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, q.config.FrequencyThreshold, len(messages))
+}
+
+func TestStoreWhenFullWithOverwrite(t *testing.T) {
+	q := DummyUnstartedQueue()
+	q.config.Overwrite = true
+	FillBuffer(q, q.config.RolloverThreshold)
+
+	err := q.Store(100)
+	assert.Nil(t, err)
+	assert.Equal(t, q.Length(), q.config.RolloverThreshold)
+
+	messages, err := q.GetMessages()
+	assert.Nil(t, err)
+	// The oldest message (0) was dropped to make room for 100.
+	assert.Equal(t, messages[0], Message(1))
+}
+
+func TestConcurrentProducerAndConsumer(t *testing.T) {
+	q := DummyQueue()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < q.config.RolloverThreshold/2; i++ {
+			q.Store(i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			q.Flush()
+		}
+	}()
+	wg.Wait()
+
+	assert.True(t, q.Length() <= q.config.RolloverThreshold)
 }
 
 func TestFlushWhenEmpty(t *testing.T) {
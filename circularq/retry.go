@@ -0,0 +1,136 @@
+package circularq
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultMinBackoff is used when RetryConfig.MinBackoffMillis is unset.
+	DefaultMinBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff is used when RetryConfig.MaxBackoffMillis is unset.
+	DefaultMaxBackoff = 10 * time.Second
+	// RetryForever is an explicit opt-in MaxRetries value that retries a
+	// failing batch indefinitely instead of ever reaching DeadLetterFunc or
+	// a terminal *FlushError.
+	RetryForever = -1
+)
+
+type (
+	// RetryConfig configures the exponential backoff retried around
+	// FlusherFunc, in the style of grafana/dskit/backoff. The zero value
+	// (MaxRetries 0), which is what a nil Config.Retry falls back to, means
+	// no retries: a single failed attempt goes straight to DeadLetterFunc
+	// (or a terminal *FlushError). Set MaxRetries to RetryForever to retry
+	// indefinitely instead.
+	RetryConfig struct {
+		MaxRetries       int `json:"max_retries"`
+		MinBackoffMillis int `json:"min_backoff_millis"`
+		MaxBackoffMillis int `json:"max_backoff_millis"`
+	}
+
+	// backoff tracks retry state for a single flush attempt.
+	backoff struct {
+		cfg     RetryConfig
+		retries int
+	}
+)
+
+func newBackoff(cfg RetryConfig) *backoff {
+	return &backoff{cfg: cfg}
+}
+
+// ongoing reports whether another retry is permitted.
+func (b *backoff) ongoing() bool {
+	return b.cfg.MaxRetries == RetryForever || b.retries < b.cfg.MaxRetries
+}
+
+// wait sleeps for the next backoff interval (full jitter between 0 and the
+// current exponential delay) and advances the retry count. It returns false
+// without completing the delay if ctx is canceled first, so a canceled
+// queue's retry loop never wedges shutdown waiting out a RetryForever
+// backoff.
+func (b *backoff) wait(ctx context.Context) (completed bool) {
+	delay := b.nextDelay()
+	b.retries++
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (b *backoff) nextDelay() time.Duration {
+	minDelay := DefaultMinBackoff
+	if b.cfg.MinBackoffMillis > 0 {
+		minDelay = time.Duration(b.cfg.MinBackoffMillis) * time.Millisecond
+	}
+	maxDelay := DefaultMaxBackoff
+	if b.cfg.MaxBackoffMillis > 0 {
+		maxDelay = time.Duration(b.cfg.MaxBackoffMillis) * time.Millisecond
+	}
+
+	delay := minDelay << uint(b.retries)
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// FlushError wraps the last error FlusherFunc returned for a batch whose
+// retries were exhausted with no DeadLetterFunc configured to absorb it.
+// The queue is left unadvanced past this batch.
+type FlushError struct {
+	Err     error
+	Retries int
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("circularq: flush failed after %d retries: %s", e.Retries, e.Err)
+}
+
+func (e *FlushError) Unwrap() error {
+	return e.Err
+}
+
+// flushWithRetry runs FlusherFunc against messages, retrying transient
+// failures with exponential backoff per q.config.Retry. Once retries are
+// exhausted - or q.Ctx is canceled, which always cuts retries short even
+// under RetryForever - it hands the batch to q.DeadLetterFunc if set; a nil
+// return from DeadLetterFunc unblocks the queue, a non-nil return (or no
+// DeadLetterFunc at all) surfaces as a terminal *FlushError and leaves the
+// batch in place for the next attempt.
+func (q *CircularQ) flushWithRetry(messages []Message) (err error) {
+	var retryCfg RetryConfig
+	if q.config.Retry != nil {
+		retryCfg = *q.config.Retry
+	}
+	b := newBackoff(retryCfg)
+
+	for {
+		if err = q.FlusherFunc(messages); err == nil {
+			return nil
+		}
+
+		canceled := false
+		select {
+		case <-q.Ctx.Done():
+			canceled = true
+		default:
+		}
+		if !canceled && b.ongoing() && b.wait(q.Ctx) {
+			continue
+		}
+
+		if q.DeadLetterFunc != nil {
+			if dlErr := q.DeadLetterFunc(messages, err); dlErr != nil {
+				return &FlushError{Err: err, Retries: b.retries}
+			}
+			return nil
+		}
+		return &FlushError{Err: err, Retries: b.retries}
+	}
+}
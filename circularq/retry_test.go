@@ -0,0 +1,63 @@
+package circularq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushRetriesThenDeadLetters(t *testing.T) {
+	attempts := 0
+	q, _ := New(context.TODO(), func(messages []Message) error {
+		attempts++
+		return errors.New("boom")
+	})
+	q.config.Retry = &RetryConfig{MaxRetries: 3, MinBackoffMillis: 1, MaxBackoffMillis: 2}
+
+	deadLettered := 0
+	q.DeadLetterFunc = func(messages []Message, err error) error {
+		deadLettered++
+		return nil
+	}
+
+	FillBuffer(q, 10)
+	err := q.Flush()
+
+	assert.Nil(t, err)
+	assert.Equal(t, attempts, 4) // one initial attempt plus 3 retries
+	assert.Equal(t, deadLettered, 1)
+	assert.Equal(t, q.Length(), 0)
+}
+
+func TestFlushTerminalErrorLeavesQueueUnadvanced(t *testing.T) {
+	q, _ := New(context.TODO(), func(messages []Message) error {
+		return errors.New("boom")
+	})
+	q.config.Retry = &RetryConfig{MaxRetries: 2, MinBackoffMillis: 1, MaxBackoffMillis: 2}
+
+	FillBuffer(q, 10)
+	err := q.Flush()
+
+	var flushErr *FlushError
+	assert.True(t, errors.As(err, &flushErr))
+	assert.Equal(t, q.Length(), 10)
+}
+
+func TestFlushWithNilRetryFailsImmediately(t *testing.T) {
+	attempts := 0
+	q, _ := New(context.TODO(), func(messages []Message) error {
+		attempts++
+		return errors.New("boom")
+	})
+	// q.config.Retry is left nil, the common/default case.
+
+	FillBuffer(q, 10)
+	err := q.Flush()
+
+	var flushErr *FlushError
+	assert.True(t, errors.As(err, &flushErr))
+	assert.Equal(t, attempts, 1)
+	assert.Equal(t, q.Length(), 10)
+}
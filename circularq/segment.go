@@ -0,0 +1,131 @@
+package circularq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const segmentFilePrefix = "seg-"
+
+// segment is a single WAL file on disk. Records are length-prefixed and
+// CRC32-checksummed: a 4-byte big-endian payload length, a 4-byte
+// big-endian IEEE CRC32 of the payload, then the payload itself.
+type segment struct {
+	path string
+	file *os.File
+	size int64
+
+	// startSeq is the sequence number of the first record in this
+	// segment, endSeq is one past the sequence number of the last record
+	// written to it.
+	startSeq uint64
+	endSeq   uint64
+}
+
+func segmentPath(dir string, startSeq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d.log", segmentFilePrefix, startSeq))
+}
+
+func createSegment(dir string, startSeq uint64) (seg *segment, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(segmentPath(dir, startSeq), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	seg = &segment{
+		path:     segmentPath(dir, startSeq),
+		file:     file,
+		startSeq: startSeq,
+		endSeq:   startSeq,
+	}
+	return
+}
+
+func openSegment(path string, startSeq uint64) (seg *segment, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	var info os.FileInfo
+	if info, err = file.Stat(); err != nil {
+		return
+	}
+	seg = &segment{
+		path:     path,
+		file:     file,
+		size:     info.Size(),
+		startSeq: startSeq,
+		endSeq:   startSeq,
+	}
+	return
+}
+
+func (s *segment) appendRecord(payload []byte, fsync bool) (err error) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	if _, err = s.file.Write(header); err != nil {
+		return
+	}
+	if _, err = s.file.Write(payload); err != nil {
+		return
+	}
+	s.size += int64(len(header) + len(payload))
+	s.endSeq++
+
+	if fsync {
+		err = s.file.Sync()
+	}
+	return
+}
+
+// readAll replays every record in the segment, in order, calling fn with
+// each record's sequence number and payload.
+func (s *segment) readAll(fn func(seq uint64, payload []byte) error) (err error) {
+	var file *os.File
+	if file, err = os.Open(s.path); err != nil {
+		return
+	}
+	defer file.Close()
+
+	seq := s.startSeq
+	header := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(file, header); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(file, payload); err != nil {
+			return
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			err = fmt.Errorf("circularq: checksum mismatch in segment %s at seq %d", s.path, seq)
+			return
+		}
+		if err = fn(seq, payload); err != nil {
+			return
+		}
+		seq++
+	}
+}
+
+func (s *segment) close() error {
+	return s.file.Close()
+}
+
+func (s *segment) remove() (err error) {
+	if err = s.file.Close(); err != nil {
+		return
+	}
+	return os.Remove(s.path)
+}
@@ -0,0 +1,255 @@
+package circularq
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// FsyncAlways fsyncs every appended record.
+	FsyncAlways = "always"
+	// FsyncInterval fsyncs the active segment on a fixed interval.
+	FsyncInterval = "interval"
+	// FsyncNever never explicitly fsyncs, relying on the OS to flush.
+	FsyncNever = "never"
+
+	// DefaultFsyncIntervalSecs is used when FsyncPolicy is FsyncInterval
+	// and FsyncIntervalSecs is not set.
+	DefaultFsyncIntervalSecs = 1
+)
+
+type (
+	// WALConfig configures the optional write-ahead log that makes Store
+	// durable across process restarts.
+	WALConfig struct {
+		Dir               string `json:"dir"`
+		SegmentSizeBytes  int64  `json:"segment_size_bytes"`
+		FsyncPolicy       string `json:"fsync_policy"`
+		FsyncIntervalSecs int    `json:"fsync_interval_secs"`
+
+		// Codec is not read from config.json, so New (which reads its
+		// config from that file) always uses JSONCodec. Set it in code on
+		// the WALConfig of a Config passed to WithBaseConfig to use another
+		// Codec. Defaults to JSONCodec.
+		Codec Codec `json:"-"`
+	}
+
+	// WAL is a write-ahead log: Append persists a message durably before
+	// the in-memory ring buffer is updated, Replay reconstructs buffered
+	// messages after a restart, and Truncate drops segments that are no
+	// longer needed once their records have been flushed.
+	WAL interface {
+		Append(msg Message) error
+		Truncate(upTo uint64) error
+		Replay(fn func(Message) error) error
+		Close() error
+	}
+
+	fileWAL struct {
+		mu sync.Mutex
+
+		dir        string
+		codec      Codec
+		fsync      string
+		segSizeCap int64
+
+		segments []*segment
+		nextSeq  uint64
+
+		stopFsync chan struct{}
+		fsyncWG   sync.WaitGroup
+	}
+)
+
+func newFileWAL(cfg *WALConfig) (w *fileWAL, err error) {
+	if cfg.Codec == nil {
+		cfg.Codec = JSONCodec{}
+	}
+	if cfg.FsyncPolicy == "" {
+		cfg.FsyncPolicy = FsyncInterval
+	}
+	if cfg.FsyncIntervalSecs <= 0 {
+		cfg.FsyncIntervalSecs = DefaultFsyncIntervalSecs
+	}
+	if err = os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return
+	}
+
+	w = &fileWAL{
+		dir:        cfg.Dir,
+		codec:      cfg.Codec,
+		fsync:      cfg.FsyncPolicy,
+		segSizeCap: cfg.SegmentSizeBytes,
+		stopFsync:  make(chan struct{}),
+	}
+	if err = w.loadSegments(); err != nil {
+		return
+	}
+	if w.fsync == FsyncInterval {
+		w.fsyncWG.Add(1)
+		go w.fsyncLoop(time.Duration(cfg.FsyncIntervalSecs) * time.Second)
+	}
+	return
+}
+
+// loadSegments discovers existing segment files in dir (in ascending
+// sequence order) and opens them, replaying the final segment's record
+// count so new Appends continue from the right sequence number.
+func (w *fileWAL) loadSegments() (err error) {
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(w.dir); err != nil {
+		return
+	}
+
+	var startSeqs []uint64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var startSeq uint64
+		if _, scanErr := fmt.Sscanf(entry.Name(), segmentFilePrefix+"%020d.log", &startSeq); scanErr != nil {
+			continue
+		}
+		startSeqs = append(startSeqs, startSeq)
+	}
+	sort.Slice(startSeqs, func(i, j int) bool { return startSeqs[i] < startSeqs[j] })
+
+	for _, startSeq := range startSeqs {
+		var seg *segment
+		if seg, err = openSegment(segmentPath(w.dir, startSeq), startSeq); err != nil {
+			return
+		}
+		// endSeq isn't persisted, so recover it by counting the records
+		// actually on disk for this segment.
+		seg.endSeq = seg.startSeq
+		if err = seg.readAll(func(seq uint64, _ []byte) error {
+			seg.endSeq = seq + 1
+			return nil
+		}); err != nil {
+			return
+		}
+		w.segments = append(w.segments, seg)
+	}
+
+	if len(w.segments) == 0 {
+		var seg *segment
+		if seg, err = createSegment(w.dir, 0); err != nil {
+			return
+		}
+		w.segments = append(w.segments, seg)
+		return
+	}
+
+	w.nextSeq = w.segments[len(w.segments)-1].endSeq
+	return
+}
+
+func (w *fileWAL) activeSegment() *segment {
+	return w.segments[len(w.segments)-1]
+}
+
+func (w *fileWAL) Append(msg Message) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var payload []byte
+	if payload, err = w.codec.Encode(msg); err != nil {
+		return
+	}
+
+	seg := w.activeSegment()
+	if w.segSizeCap > 0 && seg.size >= w.segSizeCap {
+		if seg, err = createSegment(w.dir, w.nextSeq); err != nil {
+			return
+		}
+		w.segments = append(w.segments, seg)
+	}
+
+	if err = seg.appendRecord(payload, w.fsync == FsyncAlways); err != nil {
+		return
+	}
+	w.nextSeq++
+	return
+}
+
+// Truncate drops every segment whose records have all been flushed (i.e.
+// whose endSeq <= upTo). If that removes every segment, including the one
+// Appends were landing in, a fresh empty segment is created so the WAL
+// always has somewhere to write.
+func (w *fileWAL) Truncate(upTo uint64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	kept := w.segments[:0]
+	for _, seg := range w.segments {
+		if seg.endSeq > upTo {
+			kept = append(kept, seg)
+			continue
+		}
+		if err = seg.remove(); err != nil {
+			return
+		}
+	}
+	w.segments = kept
+
+	if len(w.segments) == 0 {
+		var seg *segment
+		if seg, err = createSegment(w.dir, w.nextSeq); err != nil {
+			return
+		}
+		w.segments = append(w.segments, seg)
+	}
+	return
+}
+
+func (w *fileWAL) Replay(fn func(Message) error) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, seg := range w.segments {
+		if err = seg.readAll(func(_ uint64, payload []byte) error {
+			var msg Message
+			if msg, err = w.codec.Decode(payload); err != nil {
+				return err
+			}
+			return fn(msg)
+		}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *fileWAL) fsyncLoop(interval time.Duration) {
+	defer w.fsyncWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			w.activeSegment().file.Sync()
+			w.mu.Unlock()
+		case <-w.stopFsync:
+			return
+		}
+	}
+}
+
+func (w *fileWAL) Close() (err error) {
+	close(w.stopFsync)
+	w.fsyncWG.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, seg := range w.segments {
+		if err = seg.close(); err != nil {
+			return
+		}
+	}
+	return
+}
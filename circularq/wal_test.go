@@ -0,0 +1,83 @@
+package circularq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func DummyWALQueue(t *testing.T) (q *CircularQ) {
+	q, err := New(context.TODO(), LogFlusherFunc)
+	assert.Nil(t, err)
+
+	q.config.WAL = &WALConfig{Dir: t.TempDir(), SegmentSizeBytes: 1}
+	wal, err := newFileWAL(q.config.WAL)
+	assert.Nil(t, err)
+	q.wal = wal
+	return
+}
+
+func TestWALAppendAndReplay(t *testing.T) {
+	q := DummyWALQueue(t)
+	FillBuffer(q, 7)
+	assert.Equal(t, q.Length(), 7)
+
+	recovered := []Message{}
+	assert.Nil(t, q.wal.Replay(func(msg Message) error {
+		recovered = append(recovered, msg)
+		return nil
+	}))
+	assert.Equal(t, len(recovered), 7)
+}
+
+func TestWALRecoversUnflushedMessagesAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	q1, err := New(context.TODO(), LogFlusherFunc)
+	assert.Nil(t, err)
+	q1.config.WAL = &WALConfig{Dir: dir, SegmentSizeBytes: 1}
+	wal1, err := newFileWAL(q1.config.WAL)
+	assert.Nil(t, err)
+	q1.wal = wal1
+	FillBuffer(q1, 7)
+	assert.Nil(t, wal1.Close())
+
+	// Simulate a restart: a brand-new CircularQ pointed at the same WAL
+	// directory should recover all 7 unflushed messages.
+	q2, err := New(context.TODO(), LogFlusherFunc)
+	assert.Nil(t, err)
+	q2.config.WAL = &WALConfig{Dir: dir, SegmentSizeBytes: 1}
+	wal2, err := newFileWAL(q2.config.WAL)
+	assert.Nil(t, err)
+	assert.Nil(t, wal2.Replay(q2.storeFromReplay))
+	q2.wal = wal2
+
+	assert.Equal(t, q2.Length(), 7)
+	messages, err := q2.GetMessages()
+	assert.Nil(t, err)
+	// JSONCodec round-trips ints as float64, per its doc comment.
+	assert.Equal(t, messages[0], Message(float64(0)))
+}
+
+func TestWALTruncateDropsFlushedSegments(t *testing.T) {
+	q := DummyWALQueue(t)
+	// Flush one batch of this size via an explicit Policy. Store consults
+	// the same Policy (not config.FrequencyThreshold), so the background
+	// flush loop may take the batch first; flushMu serializes that with the
+	// explicit Flush below, and either way the batch ends up flushed.
+	batchSize := q.config.FrequencyThreshold
+	q.config.FrequencyThreshold = batchSize * 1000
+	q.Policy = FrequencyPolicy{Threshold: batchSize}
+	FillBuffer(q, batchSize)
+
+	assert.Nil(t, q.Flush())
+	assert.True(t, q.IsEmpty())
+
+	recovered := 0
+	assert.Nil(t, q.wal.Replay(func(Message) error {
+		recovered++
+		return nil
+	}))
+	assert.Equal(t, recovered, 0)
+}